@@ -0,0 +1,271 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/teleport/lib/tlsca"
+	"github.com/gravitational/teleport/lib/utils"
+
+	"github.com/gravitational/trace"
+)
+
+// trustPoolRefreshInterval is how often the background loop re-fetches the
+// Auth Server's local CA to pick up additional active/standby CAs
+// published ahead of a rotation, independent of the cert renewal cadence.
+const trustPoolRefreshInterval = 30 * time.Second
+
+// IdentityManager holds an in-memory, auto-renewing identity. It is
+// returned by Bootstrap for agents that want to run fully ephemerally:
+// the private key is generated in-process and never touches disk, and
+// certificates are refreshed in the background before they expire.
+type IdentityManager struct {
+	mu       sync.RWMutex
+	identity *Identity
+	client   ClientI
+	params   ReRegisterParams
+	servers  []utils.NetAddr
+	// extraCAs holds any additional active/standby CAs the Auth Server has
+	// published ahead of a CA rotation, on top of identity's own trusted
+	// pool, so TLSConfig keeps trusting the server through a rotation
+	// without the agent having to restart.
+	extraCAs []*x509.Certificate
+
+	closeOnce sync.Once
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// Bootstrap performs the initial Register using a short-lived join token,
+// generating the node's keypair in-process, and returns an IdentityManager
+// that keeps the identity fresh in the background. The private key is
+// never written to disk.
+func Bootstrap(ctx context.Context, params RegisterParams) (*IdentityManager, error) {
+	priv, pub, err := GenerateKeyPair()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	params.PrivateKey = priv
+	params.PublicSSHKey = pub
+	params.PublicTLSKey = pub
+
+	identity, err := Register(params)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	client, err := identity.NewClient(params.Servers)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	m := &IdentityManager{
+		identity: identity,
+		client:   client,
+		params: ReRegisterParams{
+			Client:       client,
+			ID:           params.ID,
+			PrivateKey:   priv,
+			PublicTLSKey: pub,
+			PublicSSHKey: pub,
+		},
+		servers: params.Servers,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go m.renewLoop(ctx)
+	return m, nil
+}
+
+// GetIdentity returns the current identity. The returned value is a
+// point-in-time snapshot; call GetIdentity again after a renewal to
+// observe the refreshed certificates.
+func (m *IdentityManager) GetIdentity() *Identity {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.identity
+}
+
+// TLSConfig returns a TLS client config trusting the current identity's
+// CA pool and presenting its current client certificate. The returned
+// config is re-read from the manager on every call, so it always reflects
+// the most recently renewed identity and CA pool, plus any additional
+// CAs picked up mid-rotation by refreshTrustPool.
+func (m *IdentityManager) TLSConfig() (*tls.Config, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	config, err := m.identity.ClientTLSConfig()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(m.extraCAs) == 0 {
+		return config, nil
+	}
+	if config.RootCAs == nil {
+		config.RootCAs = x509.NewCertPool()
+	}
+	for _, ca := range m.extraCAs {
+		config.RootCAs.AddCert(ca)
+	}
+	return config, nil
+}
+
+// SSHClientConfig returns a SSH client config presenting the current
+// identity's host certificate.
+func (m *IdentityManager) SSHClientConfig() (*ssh.ClientConfig, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.identity.SSHClientConfig()
+}
+
+// Close stops the background renewal loop.
+func (m *IdentityManager) Close() error {
+	m.closeOnce.Do(func() {
+		m.cancel()
+		<-m.done
+	})
+	return nil
+}
+
+// renewLoop refreshes the identity at roughly half its certificate
+// lifetime, backing off with jitter on failure so a flapping Auth Server
+// doesn't get hammered by every agent at once.
+func (m *IdentityManager) renewLoop(ctx context.Context) {
+	defer close(m.done)
+
+	backoff := time.Second
+	const maxBackoff = time.Minute
+
+	trustPoolTicker := time.NewTicker(trustPoolRefreshInterval)
+	defer trustPoolTicker.Stop()
+
+	// renewAt is fixed when an identity is obtained, so trust pool refresh
+	// ticks don't push the renewal deadline back.
+	renewAt := time.Now().Add(renewalInterval(m.GetIdentity()))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-trustPoolTicker.C:
+			m.mu.RLock()
+			client := m.client
+			m.mu.RUnlock()
+			if err := m.refreshTrustPool(client); err != nil {
+				log.Warningf("Failed to refresh trusted CA pool: %v.", err)
+			}
+			continue
+		case <-time.After(renewAt.Sub(time.Now())):
+		}
+
+		identity, err := ReRegister(m.params)
+		if err != nil {
+			log.Warningf("Failed to renew identity, retrying in %v: %v.", backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(jitter(backoff)):
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+
+		// Rebuild the client from the freshly renewed identity. m.params.Client
+		// is what the next ReRegister authenticates with, so if it's left
+		// pointing at the client built from the original (now near-expiry)
+		// certificate, the next renewal will fail and the loop will never
+		// recover.
+		client, err := identity.NewClient(m.servers)
+		if err != nil {
+			log.Warningf("Failed to build client for renewed identity, retrying in %v: %v.", backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(jitter(backoff)):
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+
+		m.mu.Lock()
+		oldClient := m.client
+		m.identity = identity
+		m.client = client
+		m.params.Client = client
+		m.mu.Unlock()
+		oldClient.Close()
+		renewAt = time.Now().Add(renewalInterval(identity))
+	}
+}
+
+// refreshTrustPool fetches the Auth Server's local CA over the manager's
+// current (still-trusted) client and merges any additional active/standby
+// CAs it reports into extraCAs, so TLSConfig keeps trusting the server
+// through a CA rotation phase without requiring a restart. It mirrors the
+// pattern pinRegisterClient uses during the initial join.
+func (m *IdentityManager) refreshTrustPool(client ClientI) error {
+	localCA, err := client.GetLocalCA()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	extraCAs := make([]*x509.Certificate, 0, len(localCA.AdditionalTLSCAs))
+	for _, rawCA := range localCA.AdditionalTLSCAs {
+		ca, err := tlsca.ParseCertificatePEM(rawCA)
+		if err != nil {
+			log.Warningf("Failed to parse additional CA reported by Auth Server: %v.", err)
+			continue
+		}
+		extraCAs = append(extraCAs, ca)
+	}
+
+	m.mu.Lock()
+	m.extraCAs = extraCAs
+	m.mu.Unlock()
+	return nil
+}
+
+// renewalInterval returns how long to wait before the next renewal
+// attempt, targeting roughly half of the identity's remaining cert
+// lifetime.
+func renewalInterval(identity *Identity) time.Duration {
+	ttl := identity.Expiry().Sub(time.Now())
+	if ttl <= 0 {
+		return 0
+	}
+	return ttl / 2
+}
+
+// jitter returns d plus up to 50% random jitter, to avoid a thundering
+// herd of agents retrying a renewal at the same instant.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+	"github.com/pborman/uuid"
+)
+
+// EnrollmentWebhookEventType is the audit event emitted for every
+// enrollment webhook call, successful or not.
+const EnrollmentWebhookEventType = "node.enrollment.webhook"
+
+// enrollmentWebhookRequest is the JSON body POSTed to an EnrollmentWebhook
+// before a joining node is issued host certificates. The body is signed
+// only when the webhook has a SharedSecret.
+type enrollmentWebhookRequest struct {
+	HostID               string            `json:"host_id"`
+	NodeName             string            `json:"node_name"`
+	Role                 teleport.Role     `json:"role"`
+	AdditionalPrincipals []string          `json:"additional_principals"`
+	RemoteAddr           string            `json:"remote_addr"`
+	Claims               map[string]string `json:"claims,omitempty"`
+}
+
+// enrollmentWebhookPatch is the optional JSON patch a webhook may return
+// on a 2xx response, merged into the issued certificate. There's no
+// mechanism for a signed host certificate to carry resource labels, so
+// unlike AdditionalPrincipals this can't include a Labels field — labels
+// are node-level static config, applied by the node itself, not the Auth
+// Server issuing its certificate.
+type enrollmentWebhookPatch struct {
+	AdditionalPrincipals []string `json:"additional_principals,omitempty"`
+}
+
+// EnrollmentWebhookEvent records the outcome of an enrollment webhook call
+// for the audit log.
+type EnrollmentWebhookEvent struct {
+	// RequestID correlates this event with the webhook's own logs via the
+	// X-Teleport-Request-ID header.
+	RequestID string
+	// HostID is the joining node's host ID.
+	HostID string
+	// Allowed is true if the webhook approved enrollment.
+	Allowed bool
+	// Error is the webhook's error body, if enrollment was denied.
+	Error string
+	// Latency is how long the webhook took to respond.
+	Latency time.Duration
+}
+
+// callEnrollmentWebhook invokes hook for a joining node, returning the
+// patch to merge into the issued certificate and an audit event
+// describing the outcome. A non-2xx response aborts enrollment with the
+// webhook's error body surfaced to the joining node.
+func callEnrollmentWebhook(hook *services.EnrollmentWebhook, req enrollmentWebhookRequest) (*enrollmentWebhookPatch, *EnrollmentWebhookEvent, error) {
+	if err := hook.CheckAndSetDefaults(); err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	requestID := uuid.New()
+	httpReq.Header.Set("X-Teleport-Request-ID", requestID)
+	if hook.SharedSecret != "" {
+		httpReq.Header.Set("X-Teleport-Signature", signEnrollmentWebhookBody(hook.SharedSecret, body))
+	}
+	for k, v := range hook.Headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	httpClient, err := enrollmentWebhookClient(hook)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+
+	start := time.Now()
+	resp, err := httpClient.Do(httpReq)
+	latency := time.Since(start)
+	if err != nil {
+		return nil, &EnrollmentWebhookEvent{RequestID: requestID, HostID: req.HostID, Allowed: false, Error: err.Error(), Latency: latency},
+			trace.Wrap(err, "enrollment webhook request failed")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &EnrollmentWebhookEvent{RequestID: requestID, HostID: req.HostID, Allowed: false, Error: err.Error(), Latency: latency},
+			trace.Wrap(err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		event := &EnrollmentWebhookEvent{RequestID: requestID, HostID: req.HostID, Allowed: false, Error: string(respBody), Latency: latency}
+		return nil, event, trace.AccessDenied("enrollment denied by webhook: %v", string(respBody))
+	}
+
+	var patch enrollmentWebhookPatch
+	if len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, &patch); err != nil {
+			return nil, &EnrollmentWebhookEvent{RequestID: requestID, HostID: req.HostID, Allowed: false, Error: err.Error(), Latency: latency},
+				trace.Wrap(err, "invalid JSON patch returned by enrollment webhook")
+		}
+	}
+
+	event := &EnrollmentWebhookEvent{RequestID: requestID, HostID: req.HostID, Allowed: true, Latency: latency}
+	return &patch, event, nil
+}
+
+// runEnrollmentWebhook calls hook for a joining node and emits the
+// node.enrollment.webhook audit event recording the outcome, whether or not
+// the webhook allowed enrollment.
+func (a *AuthServer) runEnrollmentWebhook(hook *services.EnrollmentWebhook, req enrollmentWebhookRequest) (*enrollmentWebhookPatch, error) {
+	patch, event, err := callEnrollmentWebhook(hook, req)
+	if event != nil {
+		a.EmitAuditEvent(EnrollmentWebhookEventType, event)
+	}
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return patch, nil
+}
+
+// signEnrollmentWebhookBody returns the hex-encoded HMAC-SHA256 of body
+// keyed by secret, so the receiving endpoint can verify a webhook request
+// actually came from this Auth Server and wasn't forged.
+func signEnrollmentWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// enrollmentWebhookClient builds a HTTP client with the webhook's timeout
+// and, if configured, a CA bundle used to verify the endpoint.
+func enrollmentWebhookClient(hook *services.EnrollmentWebhook) (*http.Client, error) {
+	client := &http.Client{
+		Timeout: time.Duration(hook.TimeoutSeconds) * time.Second,
+	}
+	if hook.CABundle == "" {
+		return client, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(hook.CABundle)) {
+		return nil, trace.BadParameter("enrollment_webhook.ca_bundle does not contain a valid PEM certificate")
+	}
+	client.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return client, nil
+}
@@ -19,6 +19,7 @@ package auth
 import (
 	"crypto/x509"
 	"io/ioutil"
+	"path/filepath"
 	"strings"
 
 	"github.com/gravitational/teleport"
@@ -71,11 +72,33 @@ type RegisterParams struct {
 	CAPath string
 
 	// CAPin is the SKPI hash of the CA used to verify the Auth Server.
+	//
+	// Deprecated: use CAPins instead. If both are set, CAPin is appended to
+	// CAPins.
 	CAPin string
 
+	// CAPins is a set of SKPI hashes of the CAs used to verify the Auth
+	// Server. A connection is accepted if it matches any pin in the set,
+	// which allows operators to publish a new pin ahead of a CA rotation
+	// and phase the old one out without a flag day.
+	CAPins []string
+
 	// InsecureSkipCAVerification skips checking the CA when establishing a
 	// connection the Auth Server.
 	InsecureSkipCAVerification bool
+
+	// JoinMethod is the method used to join the cluster. It defaults to
+	// JoinMethodToken, in which case Token must be set. The cloud join
+	// methods (JoinMethodAWS, JoinMethodGCP, JoinMethodAzure) prove the
+	// node's identity with a signed cloud instance identity document
+	// instead. Token is still sent, naming the ProvisionToken whose Allow
+	// list the instance is matched against.
+	JoinMethod JoinMethod
+
+	// GCPAudience is set as the audience of the GCP instance identity JWT
+	// fetched for JoinMethodGCP, so the token can't be replayed against a
+	// different Teleport cluster. Ignored for other join methods.
+	GCPAudience string
 }
 
 // Register is used to generate host keys when a node or proxy are running on
@@ -83,20 +106,14 @@ type RegisterParams struct {
 // tokens to prove a valid auth server was used to issue the joining request
 // as well as a method for the node to validate the auth server.
 func Register(params RegisterParams) (*Identity, error) {
-	// Read in the token. The token can either be passed in or come from a file
-	// on disk.
-	tok, err := readToken(params.Token)
-	if err != nil {
-		return nil, trace.Wrap(err)
-	}
-
 	// Build a client to the Auth Server. The client can either not verify the
 	// Auth Server, use a CA pin to verify the Auth Server, or a CA certificate.
 	var client *Client
+	var err error
 	switch {
 	case params.InsecureSkipCAVerification:
 		client, err = insecureRegisterClient(params)
-	case params.CAPin != "":
+	case len(caPins(params)) > 0:
 		client, err = pinRegisterClient(params)
 	case params.CAPath != "":
 		client, err = pathRegisterClient(params)
@@ -109,6 +126,24 @@ func Register(params RegisterParams) (*Identity, error) {
 	}
 	defer client.Close()
 
+	// Cloud join methods prove the node's identity with a signed instance
+	// identity document instead of a shared provisioning token.
+	if params.JoinMethod != "" && params.JoinMethod != JoinMethodToken {
+		keys, err := registerUsingIID(client, params)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return ReadIdentityFromKeyPair(
+			params.PrivateKey, keys.Cert, keys.TLSCert, keys.TLSCACerts)
+	}
+
+	// Read in the token. The token can either be passed in or come from a file
+	// on disk.
+	tok, err := readToken(params.Token)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
 	// Get the SSH and X509 certificates for a node.
 	keys, err := client.RegisterUsingToken(RegisterUsingTokenRequest{
 		Token:                tok,
@@ -145,12 +180,48 @@ func insecureRegisterClient(params RegisterParams) (*Client, error) {
 	return client, nil
 }
 
+// caPins returns the full set of CA pins to accept, combining the
+// deprecated single CAPin, the explicit CAPins list, and any pins persisted
+// to disk from a previous Register call.
+func caPins(params RegisterParams) []string {
+	var pins []string
+	pins = append(pins, params.CAPins...)
+	if params.CAPin != "" {
+		pins = append(pins, params.CAPin)
+	}
+	if params.DataDir != "" {
+		if diskPins, err := readCAPins(params.DataDir); err == nil {
+			pins = append(pins, diskPins...)
+		}
+	}
+	return utils.Deduplicate(pins)
+}
+
+// matchesAnyPin returns true if the certificate's SKPI hash matches any of
+// the provided pins.
+func matchesAnyPin(pins []string, cert *x509.Certificate) bool {
+	for _, pin := range pins {
+		if utils.CheckSKPI(pin, cert) == nil {
+			return true
+		}
+	}
+	return false
+}
+
 // pinRegisterClient first connects to the Auth Server using a insecure
-// connection to fetch the root CA. If the root CA matches the provided CA
-// pin, a connection will be re-established and the root CA will be used to
-// validate the certificate presented. If both conditions hold true, then we
-// know we are connecting to the expected Auth Server.
+// connection to fetch the root CA. If the root CA matches any pin in the
+// provided set, a connection will be re-established and the root CA will be
+// used to validate the certificate presented. If both conditions hold true,
+// then we know we are connecting to the expected Auth Server.
+//
+// Once the pinned connection is established, any additional active or
+// standby CAs reported by the Auth Server are pinned as well and the union
+// of all pins is persisted to DataDir/ca-pins, so a future CA rotation can
+// be rolled out by publishing the new pin ahead of time without requiring
+// every node to be updated in lockstep.
 func pinRegisterClient(params RegisterParams) (*Client, error) {
+	pins := caPins(params)
+
 	// Build a insecure client to the Auth Server. This is safe because even if
 	// an attacker were to MITM this connection the CA pin will not match below.
 	tlsConfig := utils.TLSConfig(params.CipherSuites)
@@ -175,9 +246,8 @@ func pinRegisterClient(params RegisterParams) (*Client, error) {
 	// Check that the SKPI pin matches the CA we fetched over a insecure
 	// connection. This makes sure the CA fetched over a insecure connection is
 	// in-fact the expected CA.
-	err = utils.CheckSKPI(params.CAPin, tlsCA)
-	if err != nil {
-		return nil, trace.Wrap(err)
+	if !matchesAnyPin(pins, tlsCA) {
+		return nil, trace.AccessDenied("CA pin from Auth Server %v does not match any configured pin", tlsCA.Subject.CommonName)
 	}
 
 	log.Infof("Joining remote cluster %v with CA pin.", tlsCA.Subject.CommonName)
@@ -194,9 +264,64 @@ func pinRegisterClient(params RegisterParams) (*Client, error) {
 		return nil, trace.Wrap(err)
 	}
 
+	// Pick up any additional active/standby CAs the Auth Server reports and
+	// persist the union of their pins so the next Register call can seed its
+	// pin set from disk ahead of a rotation. Fetch GetLocalCA again, this time
+	// over the pinned connection: the first, insecure fetch only proved the
+	// CA itself matches a trusted pin, but an attacker able to pass the pin
+	// check could still have injected extra entries into that same
+	// unauthenticated response's AdditionalTLSCAs.
+	if params.DataDir != "" {
+		localCA, err = client.GetLocalCA()
+		if err != nil {
+			client.Close()
+			return nil, trace.Wrap(err)
+		}
+		allPins := append([]string{utils.CalculateSPKI(tlsCA)}, pins...)
+		for _, rawCA := range localCA.AdditionalTLSCAs {
+			additionalCA, err := tlsca.ParseCertificatePEM(rawCA)
+			if err != nil {
+				log.Warningf("Failed to parse additional CA reported by Auth Server: %v.", err)
+				continue
+			}
+			allPins = append(allPins, utils.CalculateSPKI(additionalCA))
+		}
+		if err := writeCAPins(params.DataDir, utils.Deduplicate(allPins)); err != nil {
+			log.Warningf("Failed to persist CA pins to %v: %v.", params.DataDir, err)
+		}
+	}
+
 	return client, nil
 }
 
+// caPinsPath returns the path of the file used to persist the CA pin set
+// learned during a previous Register call.
+func caPinsPath(dataDir string) string {
+	return filepath.Join(dataDir, "ca-pins")
+}
+
+// readCAPins reads the CA pin set persisted in DataDir/ca-pins, one pin per
+// line.
+func readCAPins(dataDir string) ([]string, error) {
+	out, err := ioutil.ReadFile(caPinsPath(dataDir))
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	var pins []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			pins = append(pins, line)
+		}
+	}
+	return pins, nil
+}
+
+// writeCAPins persists the CA pin set to DataDir/ca-pins, one pin per line.
+func writeCAPins(dataDir string, pins []string) error {
+	return ioutil.WriteFile(caPinsPath(dataDir), []byte(strings.Join(pins, "\n")+"\n"), 0600)
+}
+
 // pathRegisterClient validates the connection to the Auth Server using a
 // certificate on disk.
 func pathRegisterClient(params RegisterParams) (*Client, error) {
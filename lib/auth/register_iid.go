@@ -0,0 +1,215 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// JoinMethod is the method used by a node to join the cluster.
+type JoinMethod string
+
+const (
+	// JoinMethodToken is the default join method, a node proves its
+	// identity with a shared provisioning token.
+	JoinMethodToken JoinMethod = "token"
+	// JoinMethodAWS joins a node using a signed AWS EC2 instance identity
+	// document in place of a provisioning token.
+	JoinMethodAWS JoinMethod = "aws-iid"
+	// JoinMethodGCP joins a node using a signed GCP instance identity JWT.
+	JoinMethodGCP JoinMethod = "gcp"
+	// JoinMethodAzure joins a node using an attested Azure IMDS document.
+	JoinMethodAzure JoinMethod = "azure"
+)
+
+const (
+	// awsIdentityDocumentURL is the metadata endpoint that returns the
+	// PKCS#7 signed instance identity document for the running instance.
+	awsIdentityDocumentURL = "http://169.254.169.254/latest/dynamic/instance-identity/pkcs7"
+
+	// gcpIdentityDocumentURL is the metadata endpoint that returns a signed
+	// instance identity JWT for the running instance, scoped with the
+	// Teleport cluster as audience so the JWT can't be replayed against a
+	// different cluster.
+	gcpIdentityDocumentURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity"
+
+	// azureIdentityDocumentURL is the metadata endpoint that returns the
+	// attested instance metadata document for the running instance.
+	azureIdentityDocumentURL = "http://169.254.169.254/metadata/attested/document"
+
+	// awsInstanceProfileURL is the metadata endpoint that returns the ARN
+	// of the IAM instance profile attached to the running EC2 instance, if
+	// any.
+	awsInstanceProfileURL = "http://169.254.169.254/latest/meta-data/iam/info"
+
+	// cloudMetadataTimeout bounds how long Register will wait for the
+	// instance metadata service to respond.
+	cloudMetadataTimeout = 5 * time.Second
+)
+
+// RegisterUsingIIDRequest is sent by a node joining with a cloud instance
+// identity document in place of a provisioning token.
+type RegisterUsingIIDRequest struct {
+	// JoinMethod identifies which cloud provider issued the document.
+	JoinMethod JoinMethod `json:"join_method"`
+	// Token is the name of the ProvisionToken whose Allow list the joining
+	// instance is matched against. Unlike the JoinMethodToken flow, this
+	// name is not a secret: the cloud identity document is what proves the
+	// node's identity.
+	Token string `json:"token"`
+	// HostID is a unique host ID.
+	HostID string `json:"host_id"`
+	// NodeName is a node name.
+	NodeName string `json:"node_name"`
+	// Role is a system role, e.g. Node, Proxy, Auth, etc.
+	Role teleport.Role `json:"role"`
+	// AdditionalPrincipals is a list of additional principals to dial.
+	AdditionalPrincipals []string `json:"additional_principals"`
+	// IdentityDocument is the raw, provider-signed identity document
+	// (PKCS#7 for AWS, a JWT for GCP, an attested IMDS blob for Azure).
+	IdentityDocument []byte `json:"identity_document"`
+	// AWSInstanceRoleARN is the ARN of the IAM instance profile attached to
+	// the joining EC2 instance, for JoinMethodAWS. It is not part of the
+	// signed instance identity document (AWS doesn't put IAM role in it),
+	// so it carries no cryptographic guarantee beyond being fetched from
+	// the same IMDS the identity document itself came from. It is sent with
+	// every JoinMethodAWS join (empty if no instance profile is attached or
+	// the lookup fails) and only consulted when a TokenRule sets aws_role.
+	AWSInstanceRoleARN string `json:"aws_instance_role_arn,omitempty"`
+	// PublicTLSKey is a server's public key to sign.
+	PublicTLSKey []byte `json:"public_tls_key"`
+	// PublicSSHKey is a server's public SSH key to sign.
+	PublicSSHKey []byte `json:"public_ssh_key"`
+}
+
+// fetchCloudMetadata fetches url from the local instance metadata service,
+// sending any extra headers required by that provider (e.g. GCP's
+// Metadata-Flavor).
+func fetchCloudMetadata(url string, headers map[string]string) ([]byte, error) {
+	httpClient := &http.Client{
+		Timeout: cloudMetadataTimeout,
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to fetch instance identity document")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, trace.BadParameter("instance metadata service returned status %v", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return body, nil
+}
+
+// fetchAWSIdentityDocument fetches the PKCS#7 signed instance identity
+// document from the local EC2 instance metadata service.
+func fetchAWSIdentityDocument() ([]byte, error) {
+	return fetchCloudMetadata(awsIdentityDocumentURL, nil)
+}
+
+// fetchGCPIdentityDocument fetches a signed instance identity JWT from the
+// local GCE metadata service, with the cluster name set as the JWT
+// audience.
+func fetchGCPIdentityDocument(clusterName string) ([]byte, error) {
+	url := gcpIdentityDocumentURL + "?audience=" + clusterName + "&format=full"
+	return fetchCloudMetadata(url, map[string]string{"Metadata-Flavor": "Google"})
+}
+
+// fetchAzureIdentityDocument fetches the attested instance metadata
+// document from the local Azure IMDS.
+func fetchAzureIdentityDocument() ([]byte, error) {
+	return fetchCloudMetadata(azureIdentityDocumentURL+"?api-version=2020-09-01", map[string]string{"Metadata": "true"})
+}
+
+// fetchAWSInstanceRoleARN returns the ARN of the IAM instance profile
+// attached to the running EC2 instance, or "" if none is attached. Unlike
+// the other metadata fetches, a failure here is not fatal to joining: a
+// token whose Allow rules don't set aws_role doesn't need it.
+func fetchAWSInstanceRoleARN() string {
+	body, err := fetchCloudMetadata(awsInstanceProfileURL, nil)
+	if err != nil {
+		return ""
+	}
+	var info struct {
+		InstanceProfileArn string `json:"InstanceProfileArn"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return ""
+	}
+	return info.InstanceProfileArn
+}
+
+// registerUsingIID registers a node using a cloud instance identity document
+// instead of a shared provisioning token, mirroring the Token flow in
+// Register but routed through RegisterUsingIID on the Auth Server.
+func registerUsingIID(client *Client, params RegisterParams) (*PackedKeys, error) {
+	var doc []byte
+	var err error
+
+	switch params.JoinMethod {
+	case JoinMethodAWS:
+		doc, err = fetchAWSIdentityDocument()
+	case JoinMethodGCP:
+		doc, err = fetchGCPIdentityDocument(params.GCPAudience)
+	case JoinMethodAzure:
+		doc, err = fetchAzureIdentityDocument()
+	default:
+		return nil, trace.BadParameter("unsupported join method %q for cloud attestation", params.JoinMethod)
+	}
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var roleARN string
+	if params.JoinMethod == JoinMethodAWS {
+		roleARN = fetchAWSInstanceRoleARN()
+	}
+
+	keys, err := client.RegisterUsingIID(RegisterUsingIIDRequest{
+		JoinMethod:           params.JoinMethod,
+		Token:                params.Token,
+		HostID:               params.ID.HostUUID,
+		NodeName:             params.ID.NodeName,
+		Role:                 params.ID.Role,
+		AdditionalPrincipals: params.AdditionalPrincipals,
+		IdentityDocument:     doc,
+		AWSInstanceRoleARN:   roleARN,
+		PublicTLSKey:         params.PublicTLSKey,
+		PublicSSHKey:         params.PublicSSHKey,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return keys, nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// rsaPublicKeyInfo is a single entry of a JWKS used to verify GCP instance
+// identity JWTs, keyed by "kid" in CloudAttestationConfig.GCPKeySet.
+type rsaPublicKeyInfo struct {
+	PublicKey *rsa.PublicKey
+}
+
+// gcpJWTClaims is the subset of a GCP instance identity JWT's claims
+// Teleport needs to extract the instance's project and instance ID.
+type gcpJWTClaims struct {
+	// Aud is the cluster name the JWT was minted for; it must match the
+	// verifying cluster's own name, or the JWT could be replayed against
+	// a different Teleport cluster than the one it was fetched for.
+	Aud string `json:"aud"`
+	// Exp is the JWT's standard Unix expiry timestamp.
+	Exp    int64 `json:"exp"`
+	Google struct {
+		ComputeEngine struct {
+			ProjectID  string `json:"project_id"`
+			InstanceID string `json:"instance_id"`
+		} `json:"compute_engine"`
+	} `json:"google"`
+}
+
+// verifyGCPIdentity verifies the RS256 signature on a GCP instance
+// identity JWT against the configured JWKS and returns the embedded
+// identity.
+func (a *AuthServer) verifyGCPIdentity(token []byte) (*gcpInstanceIdentity, error) {
+	parts := strings.Split(string(token), ".")
+	if len(parts) != 3 {
+		return nil, trace.BadParameter("malformed GCP instance identity JWT")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to decode GCP JWT header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, trace.Wrap(err, "failed to parse GCP JWT header")
+	}
+	if header.Alg != "RS256" {
+		return nil, trace.BadParameter("unsupported GCP JWT signature algorithm %q", header.Alg)
+	}
+
+	cfg := getCloudAttestationConfig()
+	key, ok := cfg.GCPKeySet[header.Kid]
+	if !ok {
+		return nil, trace.BadParameter("unknown GCP JWT signing key %q", header.Kid)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to decode GCP JWT signature")
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key.PublicKey, crypto.SHA256, hashed[:], sig); err != nil {
+		return nil, trace.Wrap(err, "GCP instance identity JWT signature verification failed")
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to decode GCP JWT payload")
+	}
+	var claims gcpJWTClaims
+	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
+		return nil, trace.Wrap(err, "failed to parse GCP JWT claims")
+	}
+	if claims.Exp == 0 || time.Unix(claims.Exp, 0).Before(time.Now()) {
+		return nil, trace.AccessDenied("GCP instance identity JWT has expired")
+	}
+	if cfg.GCPAudience == "" || claims.Aud != cfg.GCPAudience {
+		return nil, trace.AccessDenied("GCP instance identity JWT audience %q does not match this cluster", claims.Aud)
+	}
+
+	return &gcpInstanceIdentity{
+		ProjectID:  claims.Google.ComputeEngine.ProjectID,
+		InstanceID: claims.Google.ComputeEngine.InstanceID,
+	}, nil
+}
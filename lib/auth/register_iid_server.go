@@ -0,0 +1,260 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+
+	"github.com/fullsailor/pkcs7"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+)
+
+// awsInstanceIdentity is the JSON body embedded in the PKCS#7 signed AWS
+// instance identity document.
+type awsInstanceIdentity struct {
+	AccountID  string `json:"accountId"`
+	Region     string `json:"region"`
+	InstanceID string `json:"instanceId"`
+}
+
+// gcpInstanceIdentity is the set of claims Teleport cares about in a GCP
+// instance identity JWT.
+type gcpInstanceIdentity struct {
+	ProjectID  string `json:"project_id"`
+	InstanceID string `json:"instance_id"`
+}
+
+// azureAttestedDocument is the outer envelope returned by the Azure IMDS
+// attested document endpoint: a PKCS#7 signature over an inner, plain JSON
+// document.
+type azureAttestedDocument struct {
+	Signature string `json:"signature"`
+	Encoding  string `json:"encoding"`
+}
+
+// azureInstanceIdentity is the inner JSON document signed by the Azure
+// attested document's PKCS#7 signature.
+type azureInstanceIdentity struct {
+	SubscriptionID string `json:"subscriptionId"`
+	VMID           string `json:"vmId"`
+}
+
+// CloudAttestationConfig holds the trust material used to verify cloud
+// instance identity documents presented by the JoinMethodAWS/GCP/Azure
+// flows. Operators populate this from each provider's published signing
+// material when enabling a cloud join method.
+type CloudAttestationConfig struct {
+	// AWSRegionCertPool verifies the PKCS#7 signature on an AWS instance
+	// identity document, keyed by region.
+	AWSRegionCertPool map[string]*x509.CertPool
+	// AzureCertPool verifies the PKCS#7 signature on an Azure attested
+	// document.
+	AzureCertPool *x509.CertPool
+	// GCPKeySet verifies the RS256 signature on a GCP instance identity
+	// JWT, keyed by the JWT's "kid" header.
+	GCPKeySet map[string]*rsaPublicKeyInfo
+	// GCPAudience is the expected "aud" claim on a GCP instance identity
+	// JWT: the cluster name, so a JWT minted for a different Teleport
+	// cluster is rejected rather than silently accepted.
+	GCPAudience string
+}
+
+var (
+	cloudAttestationMu     sync.RWMutex
+	cloudAttestationConfig CloudAttestationConfig
+)
+
+// SetCloudAttestationConfig installs the trust material used to verify
+// cloud instance identity documents for the JoinMethodAWS/GCP/Azure flows.
+// It is called once during Auth Server startup; RegisterUsingIID rejects
+// every cloud-attested join with an unpopulated CloudAttestationConfig.
+func SetCloudAttestationConfig(cfg CloudAttestationConfig) {
+	cloudAttestationMu.Lock()
+	defer cloudAttestationMu.Unlock()
+	cloudAttestationConfig = cfg
+}
+
+// getCloudAttestationConfig returns the currently installed
+// CloudAttestationConfig.
+func getCloudAttestationConfig() CloudAttestationConfig {
+	cloudAttestationMu.RLock()
+	defer cloudAttestationMu.RUnlock()
+	return cloudAttestationConfig
+}
+
+// RegisterUsingIID verifies a cloud instance identity document presented
+// by a joining node in place of a provisioning token secret, checks the
+// extracted identity against the named ProvisionToken's Allow list, and
+// on success issues host certificates exactly as RegisterUsingToken does.
+// remoteAddr is the joining node's observed source address, taken from the
+// transport layer (not the request body, which the node controls) so an
+// EnrollmentWebhook can check it against an expected autoscaling group.
+func (a *AuthServer) RegisterUsingIID(req RegisterUsingIIDRequest, remoteAddr string) (*PackedKeys, error) {
+	token, err := a.GetToken(req.Token)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(token.Spec.Allow) == 0 {
+		return nil, trace.AccessDenied("token %q is not configured for cloud-attested join", req.Token)
+	}
+
+	var claims map[string]string
+	switch req.JoinMethod {
+	case JoinMethodAWS:
+		ident, err := a.verifyAWSIdentity(req.IdentityDocument)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if !services.MatchesAnyAWSIdentity(token.Spec.Allow, ident.AccountID, ident.Region, req.AWSInstanceRoleARN) {
+			return nil, trace.AccessDenied("instance %v in account %v/%v does not match token %q allow rules",
+				ident.InstanceID, ident.AccountID, ident.Region, req.Token)
+		}
+		claims = map[string]string{
+			"aws_account_id":  ident.AccountID,
+			"aws_region":      ident.Region,
+			"aws_instance_id": ident.InstanceID,
+		}
+	case JoinMethodGCP:
+		ident, err := a.verifyGCPIdentity(req.IdentityDocument)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if !services.MatchesAnyGCPIdentity(token.Spec.Allow, ident.ProjectID) {
+			return nil, trace.AccessDenied("instance %v in project %v does not match token %q allow rules",
+				ident.InstanceID, ident.ProjectID, req.Token)
+		}
+		claims = map[string]string{
+			"gcp_project_id":  ident.ProjectID,
+			"gcp_instance_id": ident.InstanceID,
+		}
+	case JoinMethodAzure:
+		ident, err := a.verifyAzureIdentity(req.IdentityDocument)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if !services.MatchesAnyAzureIdentity(token.Spec.Allow, ident.SubscriptionID) {
+			return nil, trace.AccessDenied("instance %v in subscription %v does not match token %q allow rules",
+				ident.VMID, ident.SubscriptionID, req.Token)
+		}
+		claims = map[string]string{
+			"azure_subscription_id": ident.SubscriptionID,
+			"azure_vm_id":           ident.VMID,
+		}
+	default:
+		return nil, trace.BadParameter("unsupported join method %q", req.JoinMethod)
+	}
+
+	additionalPrincipals := req.AdditionalPrincipals
+	if token.Spec.EnrollmentWebhook != nil {
+		patch, err := a.runEnrollmentWebhook(token.Spec.EnrollmentWebhook, enrollmentWebhookRequest{
+			HostID:               req.HostID,
+			NodeName:             req.NodeName,
+			Role:                 req.Role,
+			AdditionalPrincipals: req.AdditionalPrincipals,
+			RemoteAddr:           remoteAddr,
+			Claims:               claims,
+		})
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if patch != nil && len(patch.AdditionalPrincipals) > 0 {
+			additionalPrincipals = append(additionalPrincipals, patch.AdditionalPrincipals...)
+		}
+	}
+
+	keys, err := a.GenerateServerKeys(GenerateServerKeysRequest{
+		HostID:               req.HostID,
+		NodeName:             req.NodeName,
+		Roles:                teleport.Roles{req.Role},
+		AdditionalPrincipals: additionalPrincipals,
+		PublicTLSKey:         req.PublicTLSKey,
+		PublicSSHKey:         req.PublicSSHKey,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return keys, nil
+}
+
+// verifyAWSIdentity verifies the PKCS#7 signature on an AWS instance
+// identity document against the region's published public key and
+// returns the embedded identity.
+func (a *AuthServer) verifyAWSIdentity(doc []byte) (*awsInstanceIdentity, error) {
+	// The pkcs7 metadata endpoint returns the signature base64 encoded, not
+	// raw DER, so it has to be decoded before pkcs7.Parse can make sense of
+	// it.
+	der, err := base64.StdEncoding.DecodeString(string(doc))
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to base64-decode AWS instance identity document")
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to parse AWS instance identity document")
+	}
+	var ident awsInstanceIdentity
+	if err := json.Unmarshal(p7.Content, &ident); err != nil {
+		return nil, trace.Wrap(err, "failed to parse AWS instance identity JSON")
+	}
+	pool, ok := getCloudAttestationConfig().AWSRegionCertPool[ident.Region]
+	if !ok {
+		return nil, trace.BadParameter("no trusted AWS public key configured for region %q", ident.Region)
+	}
+	if err := p7.VerifyWithChain(pool); err != nil {
+		return nil, trace.Wrap(err, "AWS instance identity document signature verification failed")
+	}
+	return &ident, nil
+}
+
+// verifyAzureIdentity verifies the PKCS#7 signature on an Azure attested
+// document against the configured Azure trust root and returns the
+// embedded identity.
+func (a *AuthServer) verifyAzureIdentity(doc []byte) (*azureInstanceIdentity, error) {
+	var envelope azureAttestedDocument
+	if err := json.Unmarshal(doc, &envelope); err != nil {
+		return nil, trace.Wrap(err, "failed to parse Azure attested document envelope")
+	}
+	if envelope.Encoding != "pkcs7" {
+		return nil, trace.BadParameter("unsupported Azure attested document encoding %q", envelope.Encoding)
+	}
+	der, err := base64.StdEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to base64-decode Azure attested document signature")
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to parse Azure attested document signature")
+	}
+	azureCertPool := getCloudAttestationConfig().AzureCertPool
+	if azureCertPool == nil {
+		return nil, trace.BadParameter("no trusted Azure certificate pool configured")
+	}
+	if err := p7.VerifyWithChain(azureCertPool); err != nil {
+		return nil, trace.Wrap(err, "Azure attested document signature verification failed")
+	}
+	var ident azureInstanceIdentity
+	if err := json.Unmarshal(p7.Content, &ident); err != nil {
+		return nil, trace.Wrap(err, "failed to parse Azure instance identity JSON")
+	}
+	return &ident, nil
+}
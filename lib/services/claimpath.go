@@ -0,0 +1,154 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/gravitational/trace"
+)
+
+// claimPathSegmentRe tokenizes a ClaimPath/AttributePath expression such as
+// `groups[*].name` or `groups[?(@.type=="direct")].name` into its component
+// segments: `.field`, `[index]`, `[*]`, and `[?(@.key=="value")]`.
+var claimPathSegmentRe = regexp.MustCompile(
+	`\.([A-Za-z0-9_]+)` + // 1: .field
+		`|\[\*\]` + // wildcard index
+		`|\[(\d+)\]` + // 2: numeric index
+		`|\[\?\(@\.([A-Za-z0-9_]+)==\"([^\"]*)\"\)\]`, // 3,4: filter key, value
+)
+
+// claimPathSegment is a single step of a parsed claim path.
+type claimPathSegment struct {
+	field       string
+	index       int
+	hasIndex    bool
+	wildcard    bool
+	filterKey   string
+	filterValue string
+	isFilter    bool
+}
+
+// parseClaimPath parses a JSONPath-like claim path expression into a list
+// of segments to walk. Supported syntax: `.field`, `[index]`, `[*]`, and
+// `[?(@.key=="value")]`.
+func parseClaimPath(path string) ([]claimPathSegment, error) {
+	if path != "" && path[0] != '.' && path[0] != '[' {
+		path = "." + path
+	}
+	var segments []claimPathSegment
+	pos := 0
+	for pos < len(path) {
+		loc := claimPathSegmentRe.FindStringSubmatchIndex(path[pos:])
+		if loc == nil || loc[0] != 0 {
+			return nil, trace.BadParameter("invalid claim path %q at offset %v", path, pos)
+		}
+		match := claimPathSegmentRe.FindStringSubmatch(path[pos:])
+		switch {
+		case match[1] != "":
+			segments = append(segments, claimPathSegment{field: match[1]})
+		case match[2] != "":
+			idx, err := strconv.Atoi(match[2])
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			segments = append(segments, claimPathSegment{index: idx, hasIndex: true})
+		case match[3] != "" || match[4] != "":
+			segments = append(segments, claimPathSegment{filterKey: match[3], filterValue: match[4], isFilter: true})
+		default:
+			segments = append(segments, claimPathSegment{wildcard: true})
+		}
+		pos += loc[1]
+	}
+	if len(segments) == 0 {
+		return nil, trace.BadParameter("empty claim path")
+	}
+	return segments, nil
+}
+
+// evaluateClaimPath evaluates a parsed claim path against a claim tree
+// (the result of decoding a claim's JSON value), returning a flat list of
+// string leaves.
+func evaluateClaimPath(path string, root interface{}) ([]string, error) {
+	segments, err := parseClaimPath(path)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	nodes := []interface{}{root}
+	for _, segment := range segments {
+		var next []interface{}
+		for _, node := range nodes {
+			next = append(next, applyClaimPathSegment(segment, node)...)
+		}
+		nodes = next
+	}
+	var out []string
+	for _, node := range nodes {
+		if s, ok := node.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// applyClaimPathSegment applies a single path segment to a node, returning
+// the resulting set of child nodes.
+func applyClaimPathSegment(segment claimPathSegment, node interface{}) []interface{} {
+	switch {
+	case segment.field != "":
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if v, ok := m[segment.field]; ok {
+			return []interface{}{v}
+		}
+		return nil
+	case segment.hasIndex:
+		arr, ok := node.([]interface{})
+		if !ok || segment.index < 0 || segment.index >= len(arr) {
+			return nil
+		}
+		return []interface{}{arr[segment.index]}
+	case segment.wildcard:
+		arr, ok := node.([]interface{})
+		if !ok {
+			return nil
+		}
+		return arr
+	case segment.isFilter:
+		arr, ok := node.([]interface{})
+		if !ok {
+			return nil
+		}
+		var out []interface{}
+		for _, item := range arr {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if fmt.Sprintf("%v", m[segment.filterKey]) == segment.filterValue {
+				out = append(out, item)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/gravitational/trace"
+)
+
+// claimTemplateFuncs are the helper functions available to a
+// RoleTemplate/TraitTemplate expression, beyond the text/template builtins.
+var claimTemplateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trimPrefix": func(prefix, s string) string {
+		return strings.TrimPrefix(s, prefix)
+	},
+	"trimSuffix": func(suffix, s string) string {
+		return strings.TrimSuffix(s, suffix)
+	},
+	"replace": func(old, new, s string) string {
+		return strings.Replace(s, old, new, -1)
+	},
+	"regexReplaceAll": func(expr, repl, s string) (string, error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+		return re.ReplaceAllString(s, repl), nil
+	},
+	"split": func(sep, s string) []string {
+		return strings.Split(s, sep)
+	},
+}
+
+// claimTemplateContext is the value exposed to a RoleTemplate/TraitTemplate
+// expression as its template "."
+type claimTemplateContext struct {
+	// Claim is the matched claim/attribute value.
+	Claim string
+	// Claims is the full claim/attribute map the match was evaluated
+	// against.
+	Claims map[string]interface{}
+	// Connector identifies which connector the match came from (the OIDC
+	// Issuer or SAML EntityDescriptor/Cert-derived source), so a template
+	// shared across connectors can branch on it.
+	Connector string
+}
+
+// parseClaimTemplate parses a RoleTemplate/TraitTemplate expression,
+// failing fast on malformed syntax so misconfigured templates are caught
+// by CheckAndSetDefaults rather than at login time.
+func parseClaimTemplate(expr string) (*template.Template, error) {
+	tmpl, err := template.New("").Funcs(claimTemplateFuncs).Parse(expr)
+	if err != nil {
+		return nil, trace.BadParameter("invalid template %q: %v", expr, err)
+	}
+	return tmpl, nil
+}
+
+// evaluateClaimTemplate renders a RoleTemplate/TraitTemplate expression
+// against the matched claim value, the full claim map, and the name of the
+// connector the match came from.
+func evaluateClaimTemplate(expr string, claim string, claims map[string]interface{}, connector string) (string, error) {
+	tmpl, err := parseClaimTemplate(expr)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, claimTemplateContext{Claim: claim, Claims: claims, Connector: connector}); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return buf.String(), nil
+}
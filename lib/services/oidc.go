@@ -0,0 +1,254 @@
+/*
+Copyright 2016-2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/gravitational/trace"
+)
+
+// OIDCConnectorV2 is a version 2 resource spec for OIDC connector.
+type OIDCConnectorV2 struct {
+	// Spec contains connector specification
+	Spec OIDCConnectorSpecV2 `json:"spec"`
+}
+
+// OIDCConnectorSpecV2 is a version 2 OIDC connector spec.
+type OIDCConnectorSpecV2 struct {
+	// Issuer is the OIDC provider's issuer URL.
+	Issuer string `json:"issuer"`
+	// ClientID is the OIDC client ID registered with the provider.
+	ClientID string `json:"client_id"`
+	// ClientSecret is the OIDC client secret registered with the provider.
+	ClientSecret string `json:"client_secret"`
+	// RedirectURL is the callback URL the provider redirects back to after
+	// authentication.
+	RedirectURL string `json:"redirect_url"`
+	// ClaimsToRoles specifies a dynamic mapping from claims to roles.
+	ClaimsToRoles []ClaimMapping `json:"claims_to_roles,omitempty"`
+}
+
+// ClaimMapping is a mapping of a claim to teleport roles.
+type ClaimMapping struct {
+	// Claim is a claim name.
+	Claim string `json:"claim"`
+	// ClaimPath is an optional JSONPath-like expression (e.g.
+	// `groups[*].name`, `profile.department`) evaluated against the full
+	// claim tree to extract the values to match, for IdPs that return
+	// nested claims. When empty, Claim is looked up directly as today.
+	ClaimPath string `json:"claim_path,omitempty"`
+	// Value is a claim value to match.
+	Value string `json:"value"`
+	// Roles is a list of static teleport roles to map to, with optional
+	// "$1"-style regex capture-group substitution.
+	Roles []string `json:"roles,omitempty"`
+	// RoleTemplate is a list of Go text/template expressions evaluated to
+	// produce roles, for mappings that need more than regex capture-group
+	// substitution (conditionals, case-folding, prefix trimming). It is
+	// evaluated in addition to Roles.
+	RoleTemplate []string `json:"role_template,omitempty"`
+	// TraitTemplate renders per-user traits (e.g. login names, k8s groups,
+	// AWS ARNs) consumed downstream by role conditions, keyed by trait
+	// name.
+	TraitTemplate map[string][]string `json:"trait_template,omitempty"`
+}
+
+// CheckAndSetDefaults validates the RoleTemplate and TraitTemplate
+// expressions parse, so a misconfigured connector is rejected up front
+// instead of failing at login time.
+func (m *ClaimMapping) CheckAndSetDefaults() error {
+	for _, expr := range m.RoleTemplate {
+		if _, err := parseClaimTemplate(expr); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	for trait, exprs := range m.TraitTemplate {
+		for _, expr := range exprs {
+			if _, err := parseClaimTemplate(expr); err != nil {
+				return trace.Wrap(err, "trait %q", trait)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckAndSetDefaults validates every claim mapping in the spec.
+func (s *OIDCConnectorSpecV2) CheckAndSetDefaults() error {
+	for i := range s.ClaimsToRoles {
+		if err := s.ClaimsToRoles[i].CheckAndSetDefaults(); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// MapClaims maps claims to roles according to the connector's ClaimsToRoles
+// mapping, returning the deduplicated, ordered list of matching roles.
+func (o *OIDCConnectorV2) MapClaims(claims jose.Claims) []string {
+	var roles []string
+	for _, mapping := range o.Spec.ClaimsToRoles {
+		for _, claimValue := range mapping.getValues(claims) {
+			matched, captures := matchClaimValue(mapping.Value, claimValue)
+			if !matched {
+				continue
+			}
+			for _, role := range mapping.Roles {
+				expanded, err := expandVariable(role, captures)
+				if err != nil || expanded == "" {
+					continue
+				}
+				roles = appendUnique(roles, expanded)
+			}
+			for _, expr := range mapping.RoleTemplate {
+				rendered, err := evaluateClaimTemplate(expr, claimValue, map[string]interface{}(claims), o.Spec.Issuer)
+				if err != nil || rendered == "" {
+					continue
+				}
+				roles = appendUnique(roles, rendered)
+			}
+		}
+	}
+	return roles
+}
+
+// MapTraits renders per-user traits from the connector's ClaimsToRoles
+// mapping's TraitTemplate expressions, for use by role conditions
+// downstream. Traits are deduplicated per trait name.
+func (o *OIDCConnectorV2) MapTraits(claims jose.Claims) map[string][]string {
+	traits := make(map[string][]string)
+	for _, mapping := range o.Spec.ClaimsToRoles {
+		for _, claimValue := range mapping.getValues(claims) {
+			matched, _ := matchClaimValue(mapping.Value, claimValue)
+			if !matched {
+				continue
+			}
+			for trait, exprs := range mapping.TraitTemplate {
+				for _, expr := range exprs {
+					rendered, err := evaluateClaimTemplate(expr, claimValue, map[string]interface{}(claims), o.Spec.Issuer)
+					if err != nil || rendered == "" {
+						continue
+					}
+					traits[trait] = appendUnique(traits[trait], rendered)
+				}
+			}
+		}
+	}
+	return traits
+}
+
+// getValues returns the claim values this mapping matches against, using
+// ClaimPath to evaluate a nested claim tree if set, and falling back to a
+// top-level lookup of Claim otherwise.
+func (m *ClaimMapping) getValues(claims jose.Claims) []string {
+	if m.ClaimPath == "" {
+		return getClaimValues(claims, m.Claim)
+	}
+	values, err := evaluateClaimPath(m.ClaimPath, map[string]interface{}(claims))
+	if err != nil {
+		return nil
+	}
+	return values
+}
+
+// getClaimValues returns the values of claim as a []string, whether it was
+// stored as a single string or a list of strings.
+func getClaimValues(claims jose.Claims, claim string) []string {
+	val, ok := claims[claim]
+	if !ok {
+		return nil
+	}
+	switch v := val.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+// matchClaimValue matches a claim value against a mapping value, which may
+// be the glob "*", a plain string, or a regexp with capture groups. It
+// returns whether the value matched and the submatches captured, if any.
+func matchClaimValue(matchValue, claimValue string) (bool, []string) {
+	if matchValue == Wildcard {
+		return true, nil
+	}
+	if !isRegexp(matchValue) {
+		return matchValue == claimValue, nil
+	}
+	re, err := regexp.Compile(matchValue)
+	if err != nil {
+		return false, nil
+	}
+	m := re.FindStringSubmatch(claimValue)
+	if m == nil {
+		return false, nil
+	}
+	return true, m
+}
+
+// isRegexp returns true if value looks like a regexp rather than a literal
+// string match.
+func isRegexp(value string) bool {
+	for _, c := range value {
+		switch c {
+		case '^', '$', '(', ')', '[', ']', '.', '+', '?', '\\':
+			return true
+		}
+	}
+	return false
+}
+
+// expandVariable expands $1, $2, ... references in template using the
+// submatches captured by matchClaimValue.
+func expandVariable(template string, captures []string) (string, error) {
+	if len(captures) == 0 {
+		return template, nil
+	}
+	return regexp.MustCompile(`\$(\d+)`).ReplaceAllStringFunc(template, func(ref string) string {
+		idx, err := strconv.Atoi(ref[1:])
+		if err != nil || idx <= 0 || idx >= len(captures) {
+			return ""
+		}
+		return captures[idx]
+	}), nil
+}
+
+// appendUnique appends value to slice if it is not already present.
+func appendUnique(slice []string, value string) []string {
+	for _, existing := range slice {
+		if existing == value {
+			return slice
+		}
+	}
+	return append(slice, value)
+}
+
+// Wildcard matches any claim/attribute value.
+const Wildcard = "*"
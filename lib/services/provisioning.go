@@ -0,0 +1,222 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// ProvisionTokenV2 is a provisioning token resource: it authorizes a node
+// to join the cluster, either by presenting Token as a shared secret, or,
+// for cloud-attested joins, by satisfying one of Spec.Allow's rules (Token
+// is then just a name, not a secret).
+type ProvisionTokenV2 struct {
+	// Token is the token's name. For JoinMethodToken it is also the shared
+	// secret presented by the joining node.
+	Token string `json:"token"`
+	// Spec is the token's specification.
+	Spec ProvisionTokenSpecV2 `json:"spec"`
+}
+
+// ProvisionTokenSpecV2 is the spec for a ProvisionToken resource. In
+// addition to the shared-secret token itself, a token may carry an Allow
+// list describing which cloud instances are permitted to use a cloud join
+// method in place of the secret.
+type ProvisionTokenSpecV2 struct {
+	// Roles is a list of roles associated with the token,
+	// that will be converted to metadata in the SSH and X509
+	// certificates issued to the user of the token
+	Roles teleport.Roles `json:"roles"`
+
+	// Allow is a list of rules used to match a joining cloud instance
+	// against this token when a cloud join method is used instead of the
+	// token secret. An empty Allow list means the token cannot be used to
+	// join via a cloud join method at all.
+	Allow []*TokenRule `json:"allow,omitempty"`
+
+	// EnrollmentWebhook, if set, is invoked before a host cert is issued to
+	// a node joining with this token via a cloud join method
+	// (RegisterUsingIID), so operators can enforce custom enrollment
+	// policy (check a CMDB, verify an autoscaling group, record the
+	// enrollment externally) before the node is allowed to join. Joins that
+	// present the token as a shared secret (RegisterUsingToken) do not call
+	// it.
+	EnrollmentWebhook *EnrollmentWebhook `json:"enrollment_webhook,omitempty"`
+}
+
+// EnrollmentWebhook configures an outbound webhook invoked by the Auth
+// Server before a joining node is issued host certificates.
+type EnrollmentWebhook struct {
+	// URL is the webhook endpoint the Auth Server POSTs to.
+	URL string `json:"url"`
+	// CABundle is an optional PEM encoded CA bundle used to verify the
+	// webhook endpoint's certificate, for internal/self-signed endpoints.
+	CABundle string `json:"ca_bundle,omitempty"`
+	// Headers are additional headers sent with the webhook request, e.g.
+	// for bearer token authentication.
+	Headers map[string]string `json:"headers,omitempty"`
+	// TimeoutSeconds bounds how long the Auth Server will wait for the
+	// webhook to respond before aborting enrollment. Defaults to 5 if
+	// unset.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// SharedSecret, if set, is used to HMAC-SHA256 sign the webhook
+	// request body. The signature is sent in the X-Teleport-Signature
+	// header so the endpoint can verify the request actually came from
+	// this Auth Server and reject forged enrollment approvals.
+	SharedSecret string `json:"shared_secret,omitempty"`
+}
+
+// CheckAndSetDefaults validates every allow rule and the enrollment
+// webhook, if set, so a malformed token is rejected at config-load time
+// rather than on the first cloud-attested join attempt.
+func (s *ProvisionTokenSpecV2) CheckAndSetDefaults() error {
+	for i := range s.Allow {
+		if err := s.Allow[i].CheckAndSetDefaults(); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	if s.EnrollmentWebhook != nil {
+		if err := s.EnrollmentWebhook.CheckAndSetDefaults(); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// CheckAndSetDefaults validates the webhook config and fills in defaults.
+func (w *EnrollmentWebhook) CheckAndSetDefaults() error {
+	if w.URL == "" {
+		return trace.BadParameter("enrollment_webhook.url is required")
+	}
+	if w.TimeoutSeconds == 0 {
+		w.TimeoutSeconds = 5
+	}
+	return nil
+}
+
+// TokenRule is a rule that a joining cloud instance must satisfy for a
+// ProvisionToken to authorize it. Exactly one of AWSAccount,
+// GCPProjectIDs, or AzureSubscriptions should be set, matching the
+// JoinMethod the joining node presents.
+type TokenRule struct {
+	// AWSAccount is the AWS account ID the instance must belong to.
+	AWSAccount string `json:"aws_account,omitempty"`
+	// AWSRegions restricts the rule to instances in one of the listed
+	// regions. An empty list matches any region.
+	AWSRegions []string `json:"aws_regions,omitempty"`
+	// AWSRole, if set, is the ARN of the IAM instance profile the joining
+	// instance must have attached, as reported by its instance metadata
+	// service.
+	AWSRole string `json:"aws_role,omitempty"`
+
+	// GCPProjectIDs restricts the rule to instances in one of the listed
+	// GCP projects.
+	GCPProjectIDs []string `json:"gcp_project_ids,omitempty"`
+
+	// AzureSubscriptions restricts the rule to instances in one of the
+	// listed Azure subscriptions.
+	AzureSubscriptions []string `json:"azure_subscriptions,omitempty"`
+}
+
+// CheckAndSetDefaults checks and sets default values for a rule.
+func (r *TokenRule) CheckAndSetDefaults() error {
+	if r.AWSAccount == "" && len(r.GCPProjectIDs) == 0 && len(r.AzureSubscriptions) == 0 {
+		return trace.BadParameter("the %q rule must set aws_account, gcp_project_ids, or azure_subscriptions", "allow")
+	}
+	return nil
+}
+
+// MatchesAWSIdentity returns true if the given AWS account, region, and
+// instance profile ARN satisfy this rule.
+func (r *TokenRule) MatchesAWSIdentity(account, region, roleARN string) bool {
+	if r.AWSAccount == "" || r.AWSAccount != account {
+		return false
+	}
+	if len(r.AWSRegions) > 0 {
+		matched := false
+		for _, allowedRegion := range r.AWSRegions {
+			if allowedRegion == region {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.AWSRole != "" && r.AWSRole != roleARN {
+		return false
+	}
+	return true
+}
+
+// MatchesGCPIdentity returns true if the given GCP project ID satisfies
+// this rule.
+func (r *TokenRule) MatchesGCPIdentity(projectID string) bool {
+	for _, allowed := range r.GCPProjectIDs {
+		if allowed == projectID {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesAzureIdentity returns true if the given Azure subscription ID
+// satisfies this rule.
+func (r *TokenRule) MatchesAzureIdentity(subscriptionID string) bool {
+	for _, allowed := range r.AzureSubscriptions {
+		if allowed == subscriptionID {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesAnyAWSIdentity returns true if any rule in rules matches the given
+// AWS account/region/instance profile ARN.
+func MatchesAnyAWSIdentity(rules []*TokenRule, account, region, roleARN string) bool {
+	for _, rule := range rules {
+		if rule.MatchesAWSIdentity(account, region, roleARN) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesAnyGCPIdentity returns true if any rule in rules matches the
+// given GCP project ID.
+func MatchesAnyGCPIdentity(rules []*TokenRule, projectID string) bool {
+	for _, rule := range rules {
+		if rule.MatchesGCPIdentity(projectID) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesAnyAzureIdentity returns true if any rule in rules matches the
+// given Azure subscription ID.
+func MatchesAnyAzureIdentity(rules []*TokenRule, subscriptionID string) bool {
+	for _, rule := range rules {
+		if rule.MatchesAzureIdentity(subscriptionID) {
+			return true
+		}
+	}
+	return false
+}
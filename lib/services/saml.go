@@ -0,0 +1,201 @@
+/*
+Copyright 2016-2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	saml2 "github.com/russellhaering/gosaml2"
+
+	"github.com/gravitational/trace"
+)
+
+// SAMLConnectorV2 is a version 2 resource spec for a SAML connector.
+type SAMLConnectorV2 struct {
+	// Spec contains connector specification
+	Spec SAMLConnectorSpecV2 `json:"spec"`
+}
+
+// SAMLConnectorSpecV2 is a version 2 SAML connector spec.
+type SAMLConnectorSpecV2 struct {
+	// EntityDescriptor is the IdP's SAML metadata XML, used to discover the
+	// SSO URL and signing certificate instead of setting them individually.
+	EntityDescriptor string `json:"entity_descriptor,omitempty"`
+	// Cert is the IdP's PEM encoded signing certificate, used to verify
+	// assertions when EntityDescriptor is not set.
+	Cert string `json:"cert,omitempty"`
+	// AttributesToRoles specifies a dynamic mapping from attributes to roles.
+	AttributesToRoles []AttributeMapping `json:"attributes_to_roles,omitempty"`
+}
+
+// AttributeMapping is a mapping of a SAML attribute to teleport roles.
+type AttributeMapping struct {
+	// Name is the attribute name.
+	Name string `json:"name"`
+	// ClaimPath is an optional JSONPath-like expression evaluated against
+	// the full set of assertion attributes, for IdPs (Okta, Azure AD,
+	// Keycloak) that use dot-qualified attribute names. When empty, Name
+	// is looked up directly as today.
+	ClaimPath string `json:"claim_path,omitempty"`
+	// Value is an attribute value to match.
+	Value string `json:"value"`
+	// Roles is a list of static teleport roles to map to, with optional
+	// "$1"-style regex capture-group substitution.
+	Roles []string `json:"roles,omitempty"`
+	// RoleTemplate is a list of Go text/template expressions evaluated to
+	// produce roles. It is evaluated in addition to Roles.
+	RoleTemplate []string `json:"role_template,omitempty"`
+	// TraitTemplate renders per-user traits, keyed by trait name.
+	TraitTemplate map[string][]string `json:"trait_template,omitempty"`
+}
+
+// CheckAndSetDefaults validates the RoleTemplate and TraitTemplate
+// expressions parse, so a misconfigured connector is rejected up front
+// instead of failing at login time.
+func (m *AttributeMapping) CheckAndSetDefaults() error {
+	for _, expr := range m.RoleTemplate {
+		if _, err := parseClaimTemplate(expr); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	for trait, exprs := range m.TraitTemplate {
+		for _, expr := range exprs {
+			if _, err := parseClaimTemplate(expr); err != nil {
+				return trace.Wrap(err, "trait %q", trait)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckAndSetDefaults validates every attribute mapping in the spec.
+func (s *SAMLConnectorSpecV2) CheckAndSetDefaults() error {
+	for i := range s.AttributesToRoles {
+		if err := s.AttributesToRoles[i].CheckAndSetDefaults(); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// MapAttributes maps SAML assertion attributes to roles according to the
+// connector's AttributesToRoles mapping, returning the deduplicated,
+// ordered list of matching roles.
+func (s *SAMLConnectorV2) MapAttributes(info saml2.AssertionInfo) []string {
+	var roles []string
+	for _, mapping := range s.Spec.AttributesToRoles {
+		for _, attributeValue := range mapping.getValues(info) {
+			matched, captures := matchClaimValue(mapping.Value, attributeValue)
+			if !matched {
+				continue
+			}
+			for _, role := range mapping.Roles {
+				expanded, err := expandVariable(role, captures)
+				if err != nil || expanded == "" {
+					continue
+				}
+				roles = appendUnique(roles, expanded)
+			}
+			for _, expr := range mapping.RoleTemplate {
+				rendered, err := evaluateClaimTemplate(expr, attributeValue, attributeTree(info), s.connectorSource())
+				if err != nil || rendered == "" {
+					continue
+				}
+				roles = appendUnique(roles, rendered)
+			}
+		}
+	}
+	return roles
+}
+
+// MapTraits renders per-user traits from the connector's AttributesToRoles
+// mapping's TraitTemplate expressions. Traits are deduplicated per trait
+// name.
+func (s *SAMLConnectorV2) MapTraits(info saml2.AssertionInfo) map[string][]string {
+	traits := make(map[string][]string)
+	for _, mapping := range s.Spec.AttributesToRoles {
+		for _, attributeValue := range mapping.getValues(info) {
+			matched, _ := matchClaimValue(mapping.Value, attributeValue)
+			if !matched {
+				continue
+			}
+			for trait, exprs := range mapping.TraitTemplate {
+				for _, expr := range exprs {
+					rendered, err := evaluateClaimTemplate(expr, attributeValue, attributeTree(info), s.connectorSource())
+					if err != nil || rendered == "" {
+						continue
+					}
+					traits[trait] = appendUnique(traits[trait], rendered)
+				}
+			}
+		}
+	}
+	return traits
+}
+
+// connectorSource identifies this connector for RoleTemplate/TraitTemplate
+// expressions, preferring the EntityDescriptor (which embeds the IdP's
+// entity ID) and falling back to Cert when only a bare certificate is
+// configured.
+func (s *SAMLConnectorV2) connectorSource() string {
+	if s.Spec.EntityDescriptor != "" {
+		return s.Spec.EntityDescriptor
+	}
+	return s.Spec.Cert
+}
+
+// getValues returns the attribute values this mapping matches against,
+// using ClaimPath to evaluate the assertion's attribute tree if set (or,
+// when ClaimPath does not parse as a path expression or yields no values,
+// looking it up directly as a dot-qualified attribute name), and falling
+// back to a
+// top-level lookup of Name otherwise.
+func (m *AttributeMapping) getValues(info saml2.AssertionInfo) []string {
+	if m.ClaimPath == "" {
+		return getAttributeValues(info, m.Name)
+	}
+	if values, err := evaluateClaimPath(m.ClaimPath, attributeTree(info)); err == nil && len(values) > 0 {
+		return values
+	}
+	return getAttributeValues(info, m.ClaimPath)
+}
+
+// getAttributeValues returns the values of the named SAML assertion
+// attribute.
+func getAttributeValues(info saml2.AssertionInfo, name string) []string {
+	attr, ok := info.Values[name]
+	if !ok {
+		return nil
+	}
+	var out []string
+	for _, v := range attr.Values {
+		out = append(out, v.Value)
+	}
+	return out
+}
+
+// attributeTree converts an AssertionInfo's flat attribute map into a
+// claim-tree shape so ClaimPath expressions can be evaluated against it.
+func attributeTree(info saml2.AssertionInfo) map[string]interface{} {
+	tree := make(map[string]interface{}, len(info.Values))
+	for name, attr := range info.Values {
+		values := make([]interface{}, 0, len(attr.Values))
+		for _, v := range attr.Values {
+			values = append(values, v.Value)
+		}
+		tree[name] = values
+	}
+	return tree
+}
@@ -180,6 +180,127 @@ func (s *UserSuite) TestOIDCMapping(c *C) {
 	}
 }
 
+// TestOIDCMappingClaimPath covers the ClaimPath evaluator for claims that
+// are nested objects, arrays of objects, and `[?(@.k=="v")]` filter
+// expressions, as returned by IdPs like Okta, Azure AD, and Keycloak.
+func (s *UserSuite) TestOIDCMappingClaimPath(c *C) {
+	groups := []interface{}{
+		map[string]interface{}{"name": "devs", "type": "direct"},
+		map[string]interface{}{"name": "admins", "type": "indirect"},
+	}
+
+	testCases := []struct {
+		comment string
+		mapping ClaimMapping
+		claims  jose.Claims
+		roles   []string
+	}{
+		{
+			comment: "dotted nested object",
+			mapping: ClaimMapping{ClaimPath: "profile.department", Value: "eng", Roles: []string{"engineer"}},
+			claims:  jose.Claims{"profile": map[string]interface{}{"department": "eng"}},
+			roles:   []string{"engineer"},
+		},
+		{
+			comment: "array of objects wildcard",
+			mapping: ClaimMapping{ClaimPath: "groups[*].name", Value: "devs", Roles: []string{"dev"}},
+			claims:  jose.Claims{"groups": groups},
+			roles:   []string{"dev"},
+		},
+		{
+			comment: "array of objects indexed",
+			mapping: ClaimMapping{ClaimPath: "groups[0].name", Value: "devs", Roles: []string{"dev"}},
+			claims:  jose.Claims{"groups": groups},
+			roles:   []string{"dev"},
+		},
+		{
+			comment: "filter expression",
+			mapping: ClaimMapping{ClaimPath: `groups[?(@.type=="direct")].name`, Value: "devs", Roles: []string{"dev"}},
+			claims:  jose.Claims{"groups": groups},
+			roles:   []string{"dev"},
+		},
+		{
+			comment: "filter expression no match falls back to empty",
+			mapping: ClaimMapping{ClaimPath: `groups[?(@.type=="missing")].name`, Value: "devs", Roles: []string{"dev"}},
+			claims:  jose.Claims{"groups": groups},
+			roles:   nil,
+		},
+		{
+			comment: "empty ClaimPath falls back to top-level Claim lookup",
+			mapping: ClaimMapping{Claim: "role", Value: "admin", Roles: []string{"admin"}},
+			claims:  jose.Claims{"role": "admin"},
+			roles:   []string{"admin"},
+		},
+	}
+
+	for i, tc := range testCases {
+		comment := Commentf("OIDC ClaimPath test case %v %v", i, tc.comment)
+
+		conn := OIDCConnectorV2{Spec: OIDCConnectorSpecV2{ClaimsToRoles: []ClaimMapping{tc.mapping}}}
+		c.Assert(conn.MapClaims(tc.claims), DeepEquals, tc.roles, comment)
+	}
+}
+
+// TestSAMLMappingClaimPath covers ClaimPath on AttributeMapping falling
+// back to a direct lookup by a dot-qualified attribute name, since SAML
+// assertions carry flat attributes rather than nested JSON.
+func (s *UserSuite) TestSAMLMappingClaimPath(c *C) {
+	const attrName = "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/department"
+
+	samlConn := SAMLConnectorV2{
+		Spec: SAMLConnectorSpecV2{
+			AttributesToRoles: []AttributeMapping{
+				{ClaimPath: attrName, Value: "eng", Roles: []string{"engineer"}},
+			},
+		},
+	}
+	info := claimsToAttributes(jose.Claims{attrName: "eng"})
+	c.Assert(samlConn.MapAttributes(info), DeepEquals, []string{"engineer"})
+}
+
+// TestOIDCRoleAndTraitTemplate covers RoleTemplate/TraitTemplate
+// evaluation, including helper funcs, empty-render drops, and
+// deduplication.
+func (s *UserSuite) TestOIDCRoleAndTraitTemplate(c *C) {
+	conn := OIDCConnectorV2{
+		Spec: OIDCConnectorSpecV2{
+			ClaimsToRoles: []ClaimMapping{
+				{
+					Claim: "role", Value: "*",
+					RoleTemplate: []string{
+						`{{lower .Claim}}`,
+						`{{if eq .Claim "Admin-East"}}prod-admin{{end}}`,
+						`{{trimPrefix "Admin-" .Claim}}`,
+					},
+					TraitTemplate: map[string][]string{
+						"logins": {`{{lower .Claim}}`},
+					},
+				},
+			},
+		},
+	}
+
+	claims := jose.Claims{"role": "Admin-East"}
+	c.Assert(conn.MapClaims(claims), DeepEquals, []string{"admin-east", "prod-admin", "East"})
+	c.Assert(conn.MapTraits(claims), DeepEquals, map[string][]string{"logins": {"admin-east"}})
+
+	noMatch := jose.Claims{"role": "Other-East"}
+	c.Assert(conn.MapClaims(noMatch), DeepEquals, []string{"other-east", "Other-East"})
+}
+
+// TestClaimMappingCheckAndSetDefaults covers strict parse-time validation
+// of RoleTemplate/TraitTemplate expressions.
+func (s *UserSuite) TestClaimMappingCheckAndSetDefaults(c *C) {
+	valid := ClaimMapping{RoleTemplate: []string{`{{lower .Claim}}`}}
+	c.Assert(valid.CheckAndSetDefaults(), IsNil)
+
+	invalidRole := ClaimMapping{RoleTemplate: []string{`{{lower .Claim`}}
+	c.Assert(invalidRole.CheckAndSetDefaults(), NotNil)
+
+	invalidTrait := ClaimMapping{TraitTemplate: map[string][]string{"logins": {`{{.Claim`}}}
+	c.Assert(invalidTrait.CheckAndSetDefaults(), NotNil)
+}
+
 // claimMappingsToAttributeMappings converts oidc claim mappings to
 // attribute mappings, used in tests
 func claimMappingsToAttributeMappings(in []ClaimMapping) []AttributeMapping {